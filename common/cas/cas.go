@@ -0,0 +1,260 @@
+// Package cas implements a content-addressable store for the model,
+// blacklist, and ping-result artifacts that ipv666 produces over
+// repeated runs. It replaces the old "most recent file in a timestamped
+// directory" convention (fs.GetMostRecentFileFromDirectory et al.) with
+// artifacts keyed by the SHA-256 of their content plus a symbolic tag
+// (e.g. "model", "clean-ping", "blacklist"), giving deduplication across
+// runs, atomic swaps, and cheap "did this change since last run?"
+// queries.
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/lavalamp-/ipv666/common/logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var l = logging.DefaultLogger.Facet("cas")
+
+// Meta describes a single artifact stored under a tag.
+type Meta struct {
+	Tag       string    `json:"tag"`
+	Key       string    `json:"key"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store is a content-addressable store rooted at a base directory.
+// Every tag gets its own subdirectory containing a sharded xx/yyyy...
+// layout of content files (named by their SHA-256 hash) plus an index
+// mapping symbolic keys to the hash of the artifact last written under
+// that key.
+type Store struct {
+	baseDir string
+}
+
+// NewStore returns a Store rooted at baseDir, creating the directory if
+// it does not already exist.
+func NewStore(baseDir string) (*Store, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		l.Warnf("Error thrown when creating CAS base directory at '%s': %e", baseDir, err)
+		return nil, err
+	}
+	return &Store{baseDir: baseDir}, nil
+}
+
+type tagIndex map[string]string // key -> hash
+
+func (s *Store) tagDir(tag string) string {
+	return filepath.Join(s.baseDir, tag)
+}
+
+func (s *Store) indexPath(tag string) string {
+	return filepath.Join(s.tagDir(tag), "index.json")
+}
+
+func (s *Store) shardedPath(tag string, hash string) string {
+	return filepath.Join(s.tagDir(tag), hash[:2], hash)
+}
+
+func (s *Store) metaPath(tag string, hash string) string {
+	return s.shardedPath(tag, hash) + ".meta.json"
+}
+
+func (s *Store) loadIndex(tag string) (tagIndex, error) {
+	index := make(tagIndex)
+	data, err := ioutil.ReadFile(s.indexPath(tag))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (s *Store) saveIndex(tag string, index tagIndex) (error) {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tagDir := s.tagDir(tag)
+	if err := os.MkdirAll(tagDir, 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(tagDir, "index-*.json.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, s.indexPath(tag))
+}
+
+// GetOrCreate returns the artifact stored under (tag, key), invoking
+// create to produce its content if no artifact has been stored under
+// that key yet. The returned reader is positioned at the start of the
+// content and is safe to Seek on.
+func (s *Store) GetOrCreate(tag string, key string, create func(io.Writer) error) (io.ReadSeekCloser, Meta, error) {
+	index, err := s.loadIndex(tag)
+	if err != nil {
+		l.Warnf("Error thrown when loading CAS index for tag '%s': %e", tag, err)
+		return nil, Meta{}, err
+	}
+	if hash, ok := index[key]; ok {
+		if meta, err := s.readMeta(tag, hash); err == nil {
+			l.Infof("Found existing artifact for tag '%s' key '%s' (hash %s).", tag, key, hash)
+			reader, err := os.Open(s.shardedPath(tag, hash))
+			if err != nil {
+				return nil, Meta{}, err
+			}
+			return reader, meta, nil
+		}
+		l.Warnf("Index for tag '%s' pointed at missing artifact with hash '%s'. Recreating.", tag, hash)
+	}
+	return s.create(tag, key, index, create)
+}
+
+// Put is GetOrCreate for callers that only need the Meta describing the
+// stored artifact, not its content. It closes the reader GetOrCreate
+// returns before returning, so callers that would otherwise just
+// discard that reader (leaking its fd for the life of the process)
+// don't have to remember to close it themselves.
+func (s *Store) Put(tag string, key string, create func(io.Writer) error) (Meta, error) {
+	reader, meta, err := s.GetOrCreate(tag, key, create)
+	if err != nil {
+		return Meta{}, err
+	}
+	if err := reader.Close(); err != nil {
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+func (s *Store) create(tag string, key string, index tagIndex, create func(io.Writer) error) (io.ReadSeekCloser, Meta, error) {
+	tagDir := s.tagDir(tag)
+	if err := os.MkdirAll(tagDir, 0755); err != nil {
+		return nil, Meta{}, err
+	}
+	tmpFile, err := ioutil.TempFile(tagDir, "content-*.tmp")
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	tmpPath := tmpFile.Name()
+	hasher := sha256.New()
+	if err := create(io.MultiWriter(tmpFile, hasher)); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		l.Warnf("Error thrown when running create func for tag '%s' key '%s': %e", tag, key, err)
+		return nil, Meta{}, err
+	}
+	info, err := tmpFile.Stat()
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return nil, Meta{}, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, Meta{}, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	finalPath := s.shardedPath(tag, hash)
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+		os.Remove(tmpPath)
+		return nil, Meta{}, err
+	}
+	if _, err := os.Stat(finalPath); err == nil {
+		// Identical content already present under this tag; dedupe.
+		os.Remove(tmpPath)
+	} else if os.IsNotExist(err) {
+		if err := os.Rename(tmpPath, finalPath); err != nil {
+			os.Remove(tmpPath)
+			return nil, Meta{}, err
+		}
+	} else {
+		os.Remove(tmpPath)
+		return nil, Meta{}, err
+	}
+	meta := Meta{
+		Tag:       tag,
+		Key:       key,
+		Hash:      hash,
+		Size:      info.Size(),
+		CreatedAt: time.Now(),
+	}
+	if err := s.writeMeta(tag, hash, meta); err != nil {
+		return nil, Meta{}, err
+	}
+	index[key] = hash
+	if err := s.saveIndex(tag, index); err != nil {
+		return nil, Meta{}, err
+	}
+	l.Infof("Stored new artifact for tag '%s' key '%s' (hash %s, %d bytes).", tag, key, hash, meta.Size)
+	reader, err := os.Open(finalPath)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return reader, meta, nil
+}
+
+func (s *Store) readMeta(tag string, hash string) (Meta, error) {
+	var meta Meta
+	data, err := ioutil.ReadFile(s.metaPath(tag, hash))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+func (s *Store) writeMeta(tag string, hash string, meta Meta) (error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaPath(tag, hash), data, 0644)
+}
+
+// Tags returns the symbolic tags currently present in the store.
+func (s *Store) Tags() ([]string, error) {
+	var toReturn []string
+	entries, err := ioutil.ReadDir(s.baseDir)
+	if os.IsNotExist(err) {
+		return toReturn, nil
+	} else if err != nil {
+		l.Warnf("Error thrown when listing tags in CAS base directory '%s': %e", s.baseDir, err)
+		return toReturn, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			toReturn = append(toReturn, entry.Name())
+		}
+	}
+	return toReturn, nil
+}
+
+// Remove deletes every artifact stored under tag.
+func (s *Store) Remove(tag string) (error) {
+	l.Infof("Removing all artifacts stored under tag '%s'.", tag)
+	return os.RemoveAll(s.tagDir(tag))
+}
@@ -1,21 +1,25 @@
 package fs
 
 import (
-	"log"
+	"archive/zip"
+	"github.com/lavalamp-/ipv666/common/logging"
 	"os"
+	"path/filepath"
 	"io/ioutil"
-	"compress/zlib"
 	"io"
 	"bytes"
+	"strings"
 )
 
+var l = logging.DefaultLogger.Facet("fs")
+
 func CreateDirectoryIfNotExist(dirPath string) (error) {
-	log.Printf("Making sure that directory at '%s' exists.", dirPath)
+	l.Infof("Making sure that directory at '%s' exists.", dirPath)
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		log.Printf("No directory found at path '%s'. Creating now.", dirPath)
+		l.Infof("No directory found at path '%s'. Creating now.", dirPath)
 		return os.Mkdir(dirPath, 0755)
 	} else {
-		log.Printf("Directory at path '%s' already exists.", dirPath)
+		l.Infof("Directory at path '%s' already exists.", dirPath)
 		return nil
 	}
 }
@@ -26,7 +30,7 @@ func GetMostRecentFileFromDirectory(dirPath string) (string, error) {
 
 	files, err := ioutil.ReadDir(dirPath)
 	if err != nil {
-		log.Printf("Error thrown when reading files from directory '%s': %s", dirPath, err)
+		l.Warnf("Error thrown when reading files from directory '%s': %s", dirPath, err)
 		return "", err
 	}
 	var newestFile string = ""
@@ -49,10 +53,10 @@ func GetNonMostRecentFilesFromDirectory(dirPath string) ([]string, error) {
 	if err != nil || recentFile == ""{
 		return toReturn, err
 	}
-	log.Printf("Most recent file in directory '%s' is '%s'.", dirPath, recentFile)
+	l.Infof("Most recent file in directory '%s' is '%s'.", dirPath, recentFile)
 	files, err := ioutil.ReadDir(dirPath)
 	if err != nil {
-		log.Printf("Error thrown when trying to read files from directory '%s': '%s", dirPath, err)
+		l.Warnf("Error thrown when trying to read files from directory '%s': '%s", dirPath, err)
 		return toReturn, err
 	}
 	for _, fi := range files {
@@ -61,37 +65,176 @@ func GetNonMostRecentFilesFromDirectory(dirPath string) ([]string, error) {
 			toReturn = append(toReturn, name)
 		}
 	}
-	log.Printf("Found %d files older than the most recent '%s' in directory '%s'.", len(toReturn), recentFile, dirPath)
+	l.Infof("Found %d files older than the most recent '%s' in directory '%s'.", len(toReturn), recentFile, dirPath)
 	return toReturn, nil
 }
 
 func ZipFiles(inputPaths []string, outputPath string) (error) {
-	log.Printf("Zipping up %d files (at %s) into output path of '%s'.", len(inputPaths), inputPaths, outputPath)
+	l.Infof("Zipping up %d files (at %s) into output path of '%s'.", len(inputPaths), inputPaths, outputPath)
 	outFile, err := os.Create(outputPath)
 	if err != nil {
-		log.Printf("Error thrown when trying to create file at path '%s': %e", outFile, err)
+		l.Warnf("Error thrown when trying to create file at path '%s': %e", outFile, err)
 		return err
 	}
 	defer outFile.Close()
-	outZipFile := zlib.NewWriter(outFile)
-	defer outZipFile.Close()
+	zipWriter := zip.NewWriter(outFile)
+	defer zipWriter.Close()
 	for _, inputPath := range inputPaths {
-		log.Printf("Now processing file at '%s'.", inputPath)
-		inputFile, err := os.Open(inputPath)
+		l.Infof("Now processing file at '%s'.", inputPath)
+		if err := addFileToZip(zipWriter, inputPath); err != nil {
+			l.Warnf("Error thrown when trying to add file at '%s' to zip file at '%s': %e", inputPath, outputPath, err)
+			return err
+		}
+		l.Infof("File at path '%s' successfully added to zip file at '%s'.", inputPath, outputPath)
+	}
+	l.Infof("Successfully added %d files (at %s) into output zip file at path '%s'.", len(inputPaths), inputPaths, outputPath)
+	return nil
+}
+
+func addFileToZip(zipWriter *zip.Writer, inputPath string) (error) {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(inputPath)
+	header.Method = zip.Deflate
+	entryWriter, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entryWriter, inputFile)
+	return err
+}
+
+func UnzipFiles(archivePath string, outDir string) ([]string, error) {
+	l.Infof("Unzipping archive at '%s' into directory '%s'.", archivePath, outDir)
+	var toReturn []string
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		l.Warnf("Error thrown when opening zip archive at '%s': %e", archivePath, err)
+		return toReturn, err
+	}
+	defer archive.Close()
+	if err := CreateDirectoryIfNotExist(outDir); err != nil {
+		return toReturn, err
+	}
+	for _, entry := range archive.File {
+		outPath := filepath.Join(outDir, filepath.Base(entry.Name))
+		if err := extractZipEntry(entry, outPath); err != nil {
+			l.Warnf("Error thrown when extracting entry '%s' from zip archive at '%s': %e", entry.Name, archivePath, err)
+			return toReturn, err
+		}
+		toReturn = append(toReturn, outPath)
+	}
+	l.Infof("Successfully unzipped %d files from '%s' into '%s'.", len(toReturn), archivePath, outDir)
+	return toReturn, nil
+}
+
+func extractZipEntry(entry *zip.File, outPath string) (error) {
+	entryReader, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer entryReader.Close()
+	outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode())
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	_, err = io.Copy(outFile, entryReader)
+	return err
+}
+
+type zipEntryReader struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (z *zipEntryReader) Close() (error) {
+	entryErr := z.ReadCloser.Close()
+	archiveErr := z.archive.Close()
+	if entryErr != nil {
+		return entryErr
+	}
+	return archiveErr
+}
+
+func OpenZipEntry(archivePath string, name string) (io.ReadCloser, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		l.Warnf("Error thrown when opening zip archive at '%s': %e", archivePath, err)
+		return nil, err
+	}
+	for _, entry := range archive.File {
+		if entry.Name == name {
+			entryReader, err := entry.Open()
+			if err != nil {
+				archive.Close()
+				return nil, err
+			}
+			return &zipEntryReader{ReadCloser: entryReader, archive: archive}, nil
+		}
+	}
+	archive.Close()
+	l.Warnf("No entry named '%s' found in zip archive at '%s'.", name, archivePath)
+	return nil, os.ErrNotExist
+}
+
+// DeleteAllFilesInDirectoryExcept recursively deletes every regular file
+// under dirPath, skipping any path that is equal to, or nested under,
+// one of excludePaths. Used when part of a working directory (e.g. a
+// cas.Store or a state-machine journal/staging area) must survive a
+// cleanup pass that wipes everything else.
+func DeleteAllFilesInDirectoryExcept(dirPath string, excludePaths ...string) (int, error) {
+	l.Infof("Now deleting all regular files (recursively) starting in directory '%s', excluding %v.", dirPath, excludePaths)
+	var excludeAbs []string
+	for _, excludePath := range excludePaths {
+		abs, err := filepath.Abs(excludePath)
+		if err != nil {
+			return 0, err
+		}
+		excludeAbs = append(excludeAbs, abs)
+	}
+	numDeleted := 0
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) (error) {
 		if err != nil {
-			log.Printf("Error thrown when opening file at path '%s': %e", inputPath, err)
 			return err
 		}
-		if _, err := io.Copy(outZipFile, inputFile); err != nil {
-			log.Printf("Error thrown when trying to add file at '%s' to zip file at '%s': %e", inputPath, outputPath, err)
-			inputFile.Close()
+		abs, err := filepath.Abs(path)
+		if err != nil {
 			return err
 		}
-		log.Printf("File at path '%s' successfully added to zip file at '%s'.", inputPath, outputPath)
-		inputFile.Close()
+		for _, excluded := range excludeAbs {
+			if abs == excluded || strings.HasPrefix(abs, excluded+string(os.PathSeparator)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.Mode().IsRegular() {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			numDeleted++
+		}
+		return nil
+	})
+	if err != nil {
+		l.Warnf("Error thrown when deleting files under directory '%s': %e", dirPath, err)
+		return numDeleted, err
 	}
-	log.Printf("Successfully added %d files (at %s) into output zip file at path '%s'.", len(inputPaths), inputPaths, outputPath)
-	return nil
+	l.Infof("Deleted %d file(s) under directory '%s' (excluding %v).", numDeleted, dirPath, excludePaths)
+	return numDeleted, nil
 }
 
 func CountLinesInFile(filePath string) (int, error) {
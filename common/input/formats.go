@@ -0,0 +1,489 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// AddressIterator yields addresses one at a time so that callers don't
+// have to load an entire input file (which can run into the hundreds
+// of millions of addresses for ipv666) into memory as a []*net.IP.
+// Next returns io.EOF once exhausted.
+type AddressIterator interface {
+	Next() (*net.IP, error)
+	Close() (error)
+}
+
+// OpenFunc opens path as the format it's registered against and returns
+// an iterator over the addresses it contains.
+type OpenFunc func(path string) (AddressIterator, error)
+
+// SniffFunc reports whether the leading bytes of a file look like this
+// format. It's given at most the first 512 bytes of the file.
+type SniffFunc func(header []byte) (bool)
+
+type registeredFormat struct {
+	name  string
+	sniff SniffFunc
+	open  OpenFunc
+}
+
+var formatRegistry []*registeredFormat
+
+// RegisterFormat adds a new input format to the registry used by
+// sniffAndOpen. Formats are tried in registration order, so more
+// specific sniffers (magic bytes, structured headers) should be
+// registered ahead of looser fallbacks.
+func RegisterFormat(name string, sniff SniffFunc, open OpenFunc) {
+	formatRegistry = append(formatRegistry, &registeredFormat{name: name, sniff: sniff, open: open})
+}
+
+func init() {
+	RegisterFormat("nmap-xml", sniffNmapXML, openNmapXML)
+	RegisterFormat("zmap-csv", sniffZmapCSV, openZmapCSV)
+	RegisterFormat("masscan-list", sniffMasscanList, openMasscanList)
+	RegisterFormat("gzip", sniffGzip, openGzip)
+	RegisterFormat("zlib", sniffZlib, openZlib)
+	RegisterFormat("hex", sniffHex, openHex)
+	RegisterFormat("binary", sniffBinary, openBinary)
+}
+
+const headerPeekSize = 512
+
+func readHeader(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf := make([]byte, headerPeekSize)
+	n, err := file.Read(buf)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// sniffAndOpen detects the format of the file at path by its leading
+// bytes and opens it with the matching registered reader.
+func sniffAndOpen(path string) (AddressIterator, string, error) {
+	header, err := readHeader(path)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, format := range formatRegistry {
+		if format.sniff(header) {
+			iter, err := format.open(path)
+			return iter, format.name, err
+		}
+	}
+	return nil, "", fmt.Errorf("could not detect input file format for '%s'", path)
+}
+
+func firstLine(header []byte) (string) {
+	if idx := bytes.IndexByte(header, '\n'); idx != -1 {
+		return strings.TrimSpace(string(header[:idx]))
+	}
+	return strings.TrimSpace(string(header))
+}
+
+func firstNonCommentLine(header []byte) (string) {
+	for _, line := range strings.Split(string(header), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		return trimmed
+	}
+	return ""
+}
+
+// funcIterator adapts a pair of closures into an AddressIterator, for
+// readers (and streaming transforms such as dedup/entropy filtering)
+// that are easiest to express as a simple "give me the next one" func.
+type funcIterator struct {
+	next  func() (*net.IP, error)
+	close func() (error)
+}
+
+func (f *funcIterator) Next() (*net.IP, error) {
+	return f.next()
+}
+
+func (f *funcIterator) Close() (error) {
+	return f.close()
+}
+
+// drainIterator reads iter to completion, closing it once done. Used
+// at the tail end of the processing pipeline, where the rest of ipv666
+// still expects a concrete slice of addresses.
+func drainIterator(iter AddressIterator) ([]*net.IP, error) {
+	defer iter.Close()
+	var toReturn []*net.IP
+	for {
+		ip, err := iter.Next()
+		if err == io.EOF {
+			return toReturn, nil
+		} else if err != nil {
+			return toReturn, err
+		}
+		toReturn = append(toReturn, ip)
+	}
+}
+
+// --- newline-delimited hex addresses (the original ipv666 text format) ---
+
+func sniffHex(header []byte) (bool) {
+	line := firstLine(header)
+	if line == "" {
+		return false
+	}
+	decoded, err := hex.DecodeString(line)
+	return err == nil && len(decoded) == net.IPv6len
+}
+
+type hexIterator struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func (h *hexIterator) Next() (*net.IP, error) {
+	for h.scanner.Scan() {
+		line := strings.TrimSpace(h.scanner.Text())
+		if line == "" {
+			continue
+		}
+		decoded, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.IP(decoded)
+		return &ip, nil
+	}
+	if err := h.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (h *hexIterator) Close() (error) {
+	return h.file.Close()
+}
+
+func openHex(path string) (AddressIterator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &hexIterator{file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+// --- packed binary addresses (16 raw bytes per address, no delimiters) ---
+
+// sniffBinary is the last-resort fallback in formatRegistry: packed
+// binary addresses are just raw, uniformly-distributed bytes, so there
+// is no magic number or structural marker to key off (a real packed
+// file has roughly an 86% chance of containing a 0x0A byte in its
+// first 512 bytes, so "no newline" is not a usable discriminator).
+// Instead this accepts any non-empty header and relies on registration
+// order in init() -- every more specific format gets a chance to sniff
+// first, and binary is only reached once all of them have rejected it.
+func sniffBinary(header []byte) (bool) {
+	return len(header) > 0
+}
+
+type binaryIterator struct {
+	file *os.File
+}
+
+func (b *binaryIterator) Next() (*net.IP, error) {
+	buf := make([]byte, net.IPv6len)
+	if _, err := io.ReadFull(b.file, buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	ip := net.IP(buf)
+	return &ip, nil
+}
+
+func (b *binaryIterator) Close() (error) {
+	return b.file.Close()
+}
+
+func openBinary(path string) (AddressIterator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryIterator{file: file}, nil
+}
+
+// --- gzip- and zlib-compressed variants of any of the above ---
+
+func sniffGzip(header []byte) (bool) {
+	return len(header) >= 2 && header[0] == 0x1f && header[1] == 0x8b
+}
+
+func sniffZlib(header []byte) (bool) {
+	if len(header) < 2 || header[0] != 0x78 {
+		return false
+	}
+	switch header[1] {
+	case 0x01, 0x5e, 0x9c, 0xda:
+		return true
+	default:
+		return false
+	}
+}
+
+// decompressingIterator wraps an inner iterator sourced from a decompressed
+// temp file, removing that temp file once the caller is done with it.
+type decompressingIterator struct {
+	AddressIterator
+	tmpPath string
+}
+
+func (d *decompressingIterator) Close() (error) {
+	err := d.AddressIterator.Close()
+	os.Remove(d.tmpPath)
+	return err
+}
+
+func openCompressed(path string, newDecompressor func(io.Reader) (io.Reader, error)) (AddressIterator, error) {
+	srcFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+	decompressed, err := newDecompressor(srcFile)
+	if err != nil {
+		return nil, err
+	}
+	tmpFile, err := ioutil.TempFile("", "ipv666-decompress-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := io.Copy(tmpFile, decompressed); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	inner, _, err := sniffAndOpen(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return &decompressingIterator{AddressIterator: inner, tmpPath: tmpPath}, nil
+}
+
+func openGzip(path string) (AddressIterator, error) {
+	return openCompressed(path, func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+func openZlib(path string) (AddressIterator, error) {
+	return openCompressed(path, func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	})
+}
+
+// --- zmap CSV output (`saddr` column) ---
+
+func sniffZmapCSV(header []byte) (bool) {
+	line := firstLine(header)
+	if line == "" || !strings.Contains(line, ",") {
+		return false
+	}
+	for _, field := range strings.Split(line, ",") {
+		if strings.TrimSpace(field) == "saddr" {
+			return true
+		}
+	}
+	return false
+}
+
+type zmapCSVIterator struct {
+	file   *os.File
+	reader *csv.Reader
+	col    int
+}
+
+func (z *zmapCSVIterator) Next() (*net.IP, error) {
+	for {
+		record, err := z.reader.Read()
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		if z.col >= len(record) {
+			continue
+		}
+		ip := net.ParseIP(strings.TrimSpace(record[z.col]))
+		if ip == nil {
+			continue
+		}
+		return &ip, nil
+	}
+}
+
+func (z *zmapCSVIterator) Close() (error) {
+	return z.file.Close()
+}
+
+func openZmapCSV(path string) (AddressIterator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	col := -1
+	for i, name := range header {
+		if strings.TrimSpace(name) == "saddr" {
+			col = i
+			break
+		}
+	}
+	if col == -1 {
+		file.Close()
+		return nil, fmt.Errorf("zmap csv file '%s' has no 'saddr' column", path)
+	}
+	return &zmapCSVIterator{file: file, reader: reader, col: col}, nil
+}
+
+// --- masscan `-oL` list format ---
+
+func sniffMasscanList(header []byte) (bool) {
+	line := firstNonCommentLine(header)
+	if line == "" {
+		return false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return false
+	}
+	if fields[0] != "open" && fields[0] != "closed" {
+		return false
+	}
+	return net.ParseIP(fields[3]) != nil
+}
+
+type masscanListIterator struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func (m *masscanListIterator) Next() (*net.IP, error) {
+	for m.scanner.Scan() {
+		line := strings.TrimSpace(m.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		ip := net.ParseIP(fields[3])
+		if ip == nil {
+			continue
+		}
+		return &ip, nil
+	}
+	if err := m.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (m *masscanListIterator) Close() (error) {
+	return m.file.Close()
+}
+
+func openMasscanList(path string) (AddressIterator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &masscanListIterator{file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+// --- nmap XML output (`<address addr="..." addrtype="ipv6"/>`) ---
+
+func sniffNmapXML(header []byte) (bool) {
+	trimmed := strings.TrimSpace(string(header))
+	return strings.HasPrefix(trimmed, "<?xml") && strings.Contains(trimmed, "nmaprun")
+}
+
+type nmapXMLIterator struct {
+	file    *os.File
+	decoder *xml.Decoder
+}
+
+func (n *nmapXMLIterator) Next() (*net.IP, error) {
+	for {
+		tok, err := n.decoder.Token()
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "address" {
+			continue
+		}
+		var addr, addrType string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "addr":
+				addr = attr.Value
+			case "addrtype":
+				addrType = attr.Value
+			}
+		}
+		if addrType != "ipv6" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		return &ip, nil
+	}
+}
+
+func (n *nmapXMLIterator) Close() (error) {
+	return n.file.Close()
+}
+
+func openNmapXML(path string) (AddressIterator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &nmapXMLIterator{file: file, decoder: xml.NewDecoder(file)}, nil
+}
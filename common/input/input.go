@@ -1,33 +1,69 @@
 package input
 
 import (
+	"encoding/json"
+	"github.com/lavalamp-/ipv666/common/cas"
 	"github.com/lavalamp-/ipv666/common/config"
 	"fmt"
 	"github.com/lavalamp-/ipv666/common/shell"
-	"log"
+	"github.com/lavalamp-/ipv666/common/logging"
 	"github.com/lavalamp-/ipv666/common/fs"
 	"github.com/lavalamp-/ipv666/common/modeling"
 	"github.com/lavalamp-/ipv666/common/addressing"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"time"
 	"github.com/lavalamp-/ipv666/common/zrandom"
 	"github.com/lavalamp-/ipv666/common/statemachine"
+	"github.com/rcrowley/go-metrics"
 )
 
+var l = logging.DefaultLogger.Facet("input")
+
+var dedupeTimer = metrics.NewTimer()
+var dedupeRemovedCounter = metrics.NewCounter()
+
+func init() {
+	metrics.Register("input.dedupe.time", dedupeTimer)
+	metrics.Register("input.dedupe.removed", dedupeRemovedCounter)
+}
+
 func PrepareFromInputFile(inputFilePath string, fileType string, conf *config.Configuration) (error) {
+	// Warn (but don't block) if a previous run was interrupted mid-transition.
+	// Every write this function makes below is idempotent (cas content-addresses
+	// by hash, so re-running it just finds the existing artifact), so it's safe
+	// to simply run it again rather than attempt a more surgical resume.
+	if pending, err := statemachine.PendingTransition(conf.BaseOutputDirectory); err == nil && pending != nil {
+		l.Warnf("Found incomplete transition from '%s' to '%s' staged in '%s'. Continuing will redo it from scratch.", pending.PreviousState, pending.NextState, pending.StagingDir)
+	}
+	// Clear out staging directories left behind by transitions that were
+	// interrupted on some earlier run (anything other than the one pending
+	// transition just checked above). BeginTransition below does not resume
+	// into that pending staging directory; it always starts a fresh one, and
+	// the old one is pruned on a later run once this transition has committed.
+	if _, err := statemachine.PruneStaleStaging(conf.BaseOutputDirectory); err != nil {
+		l.Warnf("Error thrown when pruning stale staging directories under '%s': %e", conf.BaseOutputDirectory, err)
+	}
 	// Confirm that cleaning up is ok
 	err := confirmCleanUpExisting(inputFilePath, conf)
 	if err != nil {
 		return err
 	}
 	// Load addresses from input file
-	addrs, err := getIPsFromFile(inputFilePath, fileType)
+	iter, err := getIPsFromFile(inputFilePath, fileType)
 	if err != nil {
 		return err
 	}
 	// Unique addresses
-	addrs = removeDuplicateIPs(addrs, conf)
+	iter = removeDuplicateIPs(iter, conf)
 	// Filter out PSLAAC addresses
-	addrs = filterOutHighEntropyIPs(addrs, conf)
+	iter = filterOutHighEntropyIPs(iter, conf)
+	addrs, err := drainIterator(iter)
+	if err != nil {
+		return err
+	}
 	// Check that enough addresses remain
 	if len(addrs) < conf.InputMinAddresses {
 		err := confirmTooFew(len(addrs), conf)
@@ -35,18 +71,54 @@ func PrepareFromInputFile(inputFilePath string, fileType string, conf *config.Co
 			return err
 		}
 	}
-	// Delete all existing files in all directories
+	// Record the state this run is actually transitioning from (not a
+	// description of the action being performed), so state.journal stays
+	// useful for deciding how to resume an interrupted run. No state file
+	// yet just means this is the first run.
+	prevState, err := statemachine.ReadStateFile(conf.GetStateFilePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	transition, err := statemachine.BeginTransition(conf.BaseOutputDirectory, prevState, fmt.Sprintf("%v", statemachine.NETWORK_GROUP), []string{inputFilePath})
+	if err != nil {
+		return err
+	}
+	// Create an empty model and write the new addresses to the
+	// content-addressable store *before* touching anything already on
+	// disk, so a crash partway through this function never leaves the
+	// working directories wiped with nothing durable to replace them.
+	modelMeta, err := createBlankModel(inputFilePath, conf)
+	if err != nil {
+		return err
+	}
+	addrMeta, err := writeNewAddresses(addrs, conf)
+	if err != nil {
+		return err
+	}
+	// Only now that the new model and addresses are safely stored is it
+	// safe to delete stale state from previous runs.
 	err = cleanUpWorkingDirectories(conf)
 	if err != nil {
 		return err
 	}
-	// Create an empty model and write to disk
-	err = createBlankModel(inputFilePath, conf)
+	// Stage a small manifest pointing at the CAS artifacts this
+	// transition just produced, so Commit has a real file to rename
+	// into place atomically rather than only bookkeeping the journal.
+	manifest := transitionManifest{
+		InputFilePath: inputFilePath,
+		ModelHash:     modelMeta.Hash,
+		AddressesHash: addrMeta.Hash,
+		CommittedAt:   time.Now(),
+	}
+	err = transition.Stage("manifest.json", func(w io.Writer) (error) {
+		return json.NewEncoder(w).Encode(manifest)
+	})
 	if err != nil {
 		return err
 	}
-	// Write addresses to ping results file path
-	writeNewAddresses(addrs, conf)
+	if err := transition.Commit(conf.BaseOutputDirectory); err != nil {
+		return err
+	}
 	// Update state file to indicate that ping results should be checked for blacklist
 	err = updateState(conf)
 	if err != nil {
@@ -55,42 +127,103 @@ func PrepareFromInputFile(inputFilePath string, fileType string, conf *config.Co
 	return nil
 }
 
-func getIPsFromFile(inputFilePath string, inputFileType string) ([]*net.IP, error) {
-	var toReturn []*net.IP
+// getIPsFromFile opens inputFilePath for streaming. inputFileType may
+// force a specific legacy format ("bin" or "hex") for backwards
+// compatibility with callers that already know their input's shape;
+// any other value (including "" or "auto") auto-detects the format
+// from the file's leading bytes via the registry in formats.go, so
+// gzip/zlib-compressed, zmap, masscan, and nmap inputs Just Work.
+func getIPsFromFile(inputFilePath string, inputFileType string) (AddressIterator, error) {
+	var iter AddressIterator
+	var formatName string
 	var err error
-	if inputFileType == "bin" {
-		toReturn, err = addressing.ReadIPsFromBinaryFile(inputFilePath)
-	} else {
-		toReturn, err = addressing.ReadIPsFromHexFile(inputFilePath)
+	switch inputFileType {
+	case "bin":
+		formatName = "binary"
+		iter, err = openBinary(inputFilePath)
+	case "hex":
+		formatName = "hex"
+		iter, err = openHex(inputFilePath)
+	default:
+		iter, formatName, err = sniffAndOpen(inputFilePath)
 	}
 	if err != nil {
-		log.Printf("Error thrown when reading addresses from file '%s': %e", inputFilePath, err)
-	} else {
-		log.Printf("Successfully read %d addresses from %s file at '%s'.", len(toReturn), inputFileType, inputFilePath)
+		l.Warnf("Error thrown when opening addresses from file '%s': %e", inputFilePath, err)
+		return nil, err
 	}
-	return toReturn, err
+	l.Infof("Reading addresses from '%s' as %s format.", inputFilePath, formatName)
+	return iter, nil
+}
+
+// transitionManifest records which CAS artifacts a "new input file"
+// transition produced. It's staged and committed through PullerState
+// so it only becomes visible in BaseOutputDirectory once every other
+// write for the transition has landed.
+type transitionManifest struct {
+	InputFilePath string    `json:"input_file_path"`
+	ModelHash     string    `json:"model_hash"`
+	AddressesHash string    `json:"addresses_hash"`
+	CommittedAt   time.Time `json:"committed_at"`
 }
 
 func updateState(conf *config.Configuration) (error) {
 	err := statemachine.SetStateFile(conf.GetStateFilePath(), statemachine.NETWORK_GROUP)
 	if err != nil {
-		log.Printf("Error thrown when attempting to update state file at path '%s': %e", conf.GetStateFilePath(), err)
+		l.Warnf("Error thrown when attempting to update state file at path '%s': %e", conf.GetStateFilePath(), err)
 		return err
 	}
-	log.Printf("Successfully updated state file at path '%s'.", conf.GetStateFilePath())
+	l.Infof("Successfully updated state file at path '%s'.", conf.GetStateFilePath())
 	return nil
 }
 
-func writeNewAddresses(toWrite []*net.IP, conf *config.Configuration) (error) {
-	outputPath := fs.GetTimedFilePath(conf.GetPingResultDirPath())
-	log.Printf("Writing %d IP addresses to file at path '%s'.", len(toWrite), outputPath)
-	err := addressing.WriteIPsToHexFile(outputPath, toWrite)
+// writeNewAddresses stores toWrite under the "input-addresses" CAS tag.
+// These addresses come straight from the user's input file and haven't
+// been through a ping scan yet, so they get their own tag rather than
+// one that would suggest post-scan, validated ping results (which
+// data.GetCleanPingResults reads from the clean ping directory, not
+// from this store).
+func writeNewAddresses(toWrite []*net.IP, conf *config.Configuration) (cas.Meta, error) {
+	l.Infof("Writing %d IP addresses to content-addressable store.", len(toWrite))
+	store, err := cas.NewStore(conf.GetCASDirPath())
+	if err != nil {
+		l.Warnf("Error thrown when opening CAS store at '%s': %e", conf.GetCASDirPath(), err)
+		return cas.Meta{}, err
+	}
+	key := time.Now().UTC().Format(time.RFC3339Nano)
+	meta, err := store.Put("input-addresses", key, func(w io.Writer) (error) {
+		return saveToWriter(w, func(path string) (error) {
+			return addressing.WriteIPsToHexFile(path, toWrite)
+		})
+	})
+	if err != nil {
+		l.Warnf("Error thrown when writing addresses to CAS: %e", err)
+		return cas.Meta{}, err
+	}
+	l.Infof("Successfully wrote IP address list to CAS under tag 'input-addresses' (hash %s).", meta.Hash)
+	return meta, nil
+}
+
+// saveToWriter adapts a function that saves to a file path (as most of
+// ipv666's serialization helpers do) into one that writes to an
+// io.Writer, as required by cas.Store.GetOrCreate.
+func saveToWriter(w io.Writer, save func(path string) (error)) (error) {
+	tmpFile, err := ioutil.TempFile("", "ipv666-cas-*.tmp")
 	if err != nil {
-		log.Printf("Error thrown when writing addresses to path '%s': %e", outputPath, err)
 		return err
 	}
-	log.Printf("Successfully wrote IP address list to '%s'.", outputPath)
-	return nil
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+	if err := save(tmpPath); err != nil {
+		return err
+	}
+	srcFile, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	_, err = io.Copy(w, srcFile)
+	return err
 }
 
 func confirmTooFew(count int, conf *config.Configuration) (error) {
@@ -115,50 +248,109 @@ func confirmCleanUpExisting(inputFilePath string, conf *config.Configuration) (e
 	}
 }
 
-func filterOutHighEntropyIPs(ips []*net.IP, conf *config.Configuration) ([]*net.IP) {
-	log.Printf("Now removing high entropy IP addresses from list of length %d (%f threshold, %d bits).", len(ips), conf.InputEntropyThreshold, conf.InputEntropyBitLength)
-	var toReturn []*net.IP
-	for i, ip := range ips {
-		if i % conf.InputEmitFreq == 0 {
-			log.Printf("Processing %d out of %d for high entropy IPs.", i, len(ips))
-		}
-		ipBytes := ([]byte)(*ip)
-		entropy := zrandom.GetEntropyOfBitsFromRight(ipBytes, conf.InputEntropyBitLength)
-		if entropy < conf.InputEntropyThreshold {
-			toReturn = append(toReturn, ip)
-		}
+// filterOutHighEntropyIPs streams iter, dropping PSLAAC (high entropy)
+// addresses as it goes rather than requiring the full address list to
+// be resident in memory up front.
+func filterOutHighEntropyIPs(iter AddressIterator, conf *config.Configuration) (AddressIterator) {
+	l.Infof("Now filtering high entropy IP addresses from input stream (%f threshold, %d bits).", conf.InputEntropyThreshold, conf.InputEntropyBitLength)
+	var seen, removed int
+	return &funcIterator{
+		next: func() (*net.IP, error) {
+			for {
+				ip, err := iter.Next()
+				if err != nil {
+					if err == io.EOF {
+						l.Infof("Finished filtering high entropy IP addresses: saw %d, removed %d.", seen, removed)
+					}
+					return nil, err
+				}
+				seen++
+				if seen % conf.InputEmitFreq == 0 {
+					l.Debugf("Processed %d addresses for high entropy so far (%d removed).", seen, removed)
+				}
+				ipBytes := ([]byte)(*ip)
+				entropy := zrandom.GetEntropyOfBitsFromRight(ipBytes, conf.InputEntropyBitLength)
+				if entropy >= conf.InputEntropyThreshold {
+					removed++
+					continue
+				}
+				return ip, nil
+			}
+		},
+		close: iter.Close,
 	}
-	log.Printf("Resulting list is %d long (removed %d high entropy addresses).", len(toReturn), len(ips) - len(toReturn))
-	return toReturn
 }
 
-func removeDuplicateIPs(ips []*net.IP, conf *config.Configuration) ([]*net.IP) {
-	log.Printf("Now removing duplicates from list of IP addresses of length %d.", len(ips))
-	toReturn := addressing.GetUniqueIPs(ips, conf.InputEmitFreq)
-	log.Printf("Resulting list is %d long (removed %d duplicates).", len(toReturn), len(ips) - len(toReturn))
-	return toReturn
+// removeDuplicateIPs streams iter, dropping addresses already seen.
+// Dedup state is a set of string-formatted addresses rather than the
+// full []*net.IP the old addressing.GetUniqueIPs required up front.
+func removeDuplicateIPs(iter AddressIterator, conf *config.Configuration) (AddressIterator) {
+	l.Infof("Now removing duplicates from input IP address stream.")
+	seenAddrs := make(map[string]bool)
+	var seen, removed int
+	start := time.Now()
+	return &funcIterator{
+		next: func() (*net.IP, error) {
+			for {
+				ip, err := iter.Next()
+				if err != nil {
+					if err == io.EOF {
+						dedupeTimer.Update(time.Since(start))
+						dedupeRemovedCounter.Inc(int64(removed))
+						l.Infof("Finished removing duplicates: saw %d, removed %d.", seen, removed)
+					}
+					return nil, err
+				}
+				seen++
+				if seen % conf.InputEmitFreq == 0 {
+					l.Debugf("Processed %d addresses for duplicates so far (%d removed).", seen, removed)
+				}
+				key := ip.String()
+				if seenAddrs[key] {
+					removed++
+					continue
+				}
+				seenAddrs[key] = true
+				return ip, nil
+			}
+		},
+		close: iter.Close,
+	}
 }
 
 func cleanUpWorkingDirectories(conf *config.Configuration) (error) {
-	log.Printf("Now deleting all regular files (recursively) starting in directory '%s'.", conf.BaseOutputDirectory)
-	numDeleted, err := fs.DeleteAllFilesInDirectory(conf.BaseOutputDirectory)
+	// The cas.Store and the state machine's own journal/staging area
+	// both live under BaseOutputDirectory, just like every other
+	// directory this cleanup targets -- exclude them so that a wipe
+	// run right after createBlankModel/writeNewAddresses doesn't delete
+	// the artifacts (and journal entry) those calls just durably wrote.
+	exclude := append([]string{conf.GetCASDirPath()}, statemachine.ReservedPaths(conf.BaseOutputDirectory)...)
+	l.Infof("Now deleting all regular files (recursively) starting in directory '%s', preserving %v.", conf.BaseOutputDirectory, exclude)
+	numDeleted, err := fs.DeleteAllFilesInDirectoryExcept(conf.BaseOutputDirectory, exclude...)
 	if err != nil {
-		log.Printf("Error thrown when deleting files under directory '%s': %e", conf.BaseOutputDirectory, err)
+		l.Warnf("Error thrown when deleting files under directory '%s': %e", conf.BaseOutputDirectory, err)
 		return err
 	}
-	log.Printf("Successfully deleted %d files.", numDeleted)
+	l.Infof("Successfully deleted %d files.", numDeleted)
 	return nil
 }
 
-func createBlankModel(inputFilePath string, conf *config.Configuration) (error) {
-	log.Printf("Now creating a blank statistical model.")
+func createBlankModel(inputFilePath string, conf *config.Configuration) (cas.Meta, error) {
+	l.Infof("Now creating a blank statistical model.")
+	store, err := cas.NewStore(conf.GetCASDirPath())
+	if err != nil {
+		l.Warnf("Error thrown when opening CAS store at '%s': %e", conf.GetCASDirPath(), err)
+		return cas.Meta{}, err
+	}
 	model := modeling.NewAddressModel(fmt.Sprintf("Model from %s", inputFilePath))
-	outputPath := fs.GetTimedFilePath(conf.GetGeneratedModelDirPath())
-	log.Printf("Writing blank statistical model with name '%s' to file '%s'.", model.Name, outputPath)
-	err := model.Save(outputPath)
+	l.Infof("Writing blank statistical model with name '%s' to CAS.", model.Name)
+	meta, err := store.Put("model", inputFilePath, func(w io.Writer) (error) {
+		return saveToWriter(w, model.Save)
+	})
 	if err != nil {
-		log.Printf("Error thrown when saving model '%s' to file '%s': %e", model.Name, outputPath, err)
-		return err
+		l.Warnf("Error thrown when saving model '%s' to CAS: %e", model.Name, err)
+		return cas.Meta{}, err
 	}
-	return nil
+	l.Infof("Successfully wrote blank statistical model '%s' to CAS (hash %s).", model.Name, meta.Hash)
+	return meta, nil
 }
@@ -0,0 +1,133 @@
+// Package metrics exposes the timers and counters that ipv666's state
+// machine registers with github.com/rcrowley/go-metrics over HTTP, so
+// long runs can be graphed instead of only ever being visible in log
+// lines. It serves Prometheus text format at /metrics, expvar JSON at
+// /debug/vars, a basic liveness check at /healthz, and can optionally
+// mount net/http/pprof handlers for diagnosing the input pipeline's
+// memory use on huge address lists.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/lavalamp-/ipv666/common/config"
+	"github.com/lavalamp-/ipv666/common/logging"
+	gometrics "github.com/rcrowley/go-metrics"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+)
+
+var l = logging.DefaultLogger.Facet("metrics")
+
+// Server is an HTTP server exposing go-metrics' default registry.
+type Server struct {
+	httpServer *http.Server
+}
+
+// NewServer builds a metrics Server bound to bindAddr. If enablePprof
+// is true, net/http/pprof's handlers are mounted under /debug/pprof/.
+func NewServer(bindAddr string, enablePprof bool) (*Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return &Server{
+		httpServer: &http.Server{
+			Addr:    bindAddr,
+			Handler: mux,
+		},
+	}
+}
+
+// NewServerFromConfig builds a metrics Server using the bind address
+// and pprof toggle configured in conf.
+func NewServerFromConfig(conf *config.Configuration) (*Server) {
+	return NewServer(conf.MetricsBindAddress, conf.MetricsEnablePprof)
+}
+
+// ListenAndServe starts serving metrics traffic and blocks until the
+// server is shut down or fails.
+func (s *Server) ListenAndServe() (error) {
+	l.Infof("Starting metrics HTTP server on '%s'.", s.httpServer.Addr)
+	err := s.httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		l.Warnf("Error thrown when serving metrics on '%s': %e", s.httpServer.Addr, err)
+	}
+	return err
+}
+
+// Shutdown stops the metrics HTTP server.
+func (s *Server) Shutdown() (error) {
+	l.Infof("Shutting down metrics HTTP server on '%s'.", s.httpServer.Addr)
+	return s.httpServer.Close()
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WritePrometheus(w, gometrics.DefaultRegistry)
+}
+
+// WritePrometheus renders every metric in registry as Prometheus text
+// exposition format.
+func WritePrometheus(w io.Writer, registry gometrics.Registry) {
+	var names []string
+	registry.Each(func(name string, _ interface{}) {
+		names = append(names, name)
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		metricName := sanitizeMetricName(name)
+		switch m := registry.Get(name).(type) {
+		case gometrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", metricName, metricName, m.Count())
+		case gometrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", metricName, metricName, m.Value())
+		case gometrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %f\n", metricName, metricName, m.Value())
+		case gometrics.Meter:
+			snap := m.Snapshot()
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %f\n", metricName+"_rate1", metricName+"_rate1", snap.Rate1())
+			fmt.Fprintf(w, "%s_count %d\n", metricName, snap.Count())
+		case gometrics.Timer:
+			snap := m.Snapshot()
+			fmt.Fprintf(w, "# TYPE %s summary\n", metricName)
+			fmt.Fprintf(w, "%s_count %d\n", metricName, snap.Count())
+			fmt.Fprintf(w, "%s{quantile=\"0.5\"} %f\n", metricName, snap.Percentile(0.5))
+			fmt.Fprintf(w, "%s{quantile=\"0.9\"} %f\n", metricName, snap.Percentile(0.9))
+			fmt.Fprintf(w, "%s{quantile=\"0.99\"} %f\n", metricName, snap.Percentile(0.99))
+		}
+	}
+}
+
+// sanitizeMetricName rewrites name so it matches Prometheus' metric
+// name grammar ([a-zA-Z_:][a-zA-Z0-9_:]*), since go-metrics names like
+// "addrupdate.file_write.time" use dots as separators.
+func sanitizeMetricName(name string) (string) {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
@@ -1,53 +1,62 @@
 package statemachine
 
 import (
+	"github.com/lavalamp-/ipv666/common/cas"
 	"github.com/lavalamp-/ipv666/common/config"
 	"github.com/lavalamp-/ipv666/common/data"
-	"log"
-	"os"
+	"github.com/lavalamp-/ipv666/common/logging"
+	"io"
 	"fmt"
 	"github.com/rcrowley/go-metrics"
 	"time"
 	"bufio"
 )
 
+var l = logging.DefaultLogger.Facet("state")
+
 var addressUpdateTimer = metrics.NewTimer()
 
 func init() {
 	metrics.Register("addrupdate.file_write.time", addressUpdateTimer)
 }
 
+//TODO don't write addresses in input file in output file
 func updateAddressFile(conf *config.Configuration) (error) {
 	cleanPings, err := data.GetCleanPingResults(conf.GetCleanPingDirPath())
 	if err != nil {
 		return err
 	}
-	//TODO don't write addresses in input file in output file
-	outputPath := conf.GetOutputFilePath()
-	log.Printf("Updating file at path '%s' with %d newly-found IP addresses.", outputPath, len(cleanPings))
-	file, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	writer := bufio.NewWriter(file)
+	l.Infof("Updating content-addressable store with %d newly-found IP addresses.", len(cleanPings))
+	store, err := cas.NewStore(conf.GetCASDirPath())
 	if err != nil {
+		l.Warnf("Error thrown when opening CAS store at '%s': %e", conf.GetCASDirPath(), err)
 		return err
 	}
-	defer file.Close()
 	start := time.Now()
-	if conf.OutputFileType != "bin" {
-		if !(conf.OutputFileType == "text") { //TODO figure out why the != check fails but this works
-			log.Printf("Unexpected file format for output (%s). Defaulting to text.", conf.OutputFileType)
-		}
-		for _, addr := range cleanPings {
-			writer.WriteString(fmt.Sprintf("%s\n", addr))
+	key := start.UTC().Format(time.RFC3339Nano)
+	meta, err := store.Put("output-addresses", key, func(w io.Writer) (error) {
+		writer := bufio.NewWriter(w)
+		if conf.OutputFileType != "bin" {
+			if !(conf.OutputFileType == "text") { //TODO figure out why the != check fails but this works
+				l.Warnf("Unexpected file format for output (%s). Defaulting to text.", conf.OutputFileType)
+			}
+			for _, addr := range cleanPings {
+				writer.WriteString(fmt.Sprintf("%s\n", addr))
+			}
+		} else {
+			for _, addr := range cleanPings {
+				toWrite := ([]byte)(*addr)
+				writer.Write(toWrite)
+			}
 		}
-	} else {
-		for _, addr := range cleanPings {
-			toWrite := ([]byte)(*addr)
-			writer.Write(toWrite)
-		}
-	}
-	writer.Flush()
+		return writer.Flush()
+	})
 	elapsed := time.Since(start)
 	addressUpdateTimer.Update(elapsed)
-	log.Printf("Finished writing %d addresses to '%s'.", len(cleanPings), outputPath)
+	if err != nil {
+		l.Warnf("Error thrown when writing addresses to CAS: %e", err)
+		return err
+	}
+	l.Infof("Finished writing %d addresses to CAS under tag 'output-addresses' (hash %s).", len(cleanPings), meta.Hash)
 	return nil
 }
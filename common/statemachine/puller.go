@@ -0,0 +1,297 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var transitionCommitTimer = metrics.NewTimer()
+var transitionCommitCounter = metrics.NewCounter()
+
+func init() {
+	metrics.Register("statemachine.transition_commit.time", transitionCommitTimer)
+	metrics.Register("statemachine.transition_commit.count", transitionCommitCounter)
+}
+
+// JournalEntry records a single state-machine transition having been
+// started (Completed == false) or finished (Completed == true), so
+// that an interrupted ipv666 run can tell where it left off instead of
+// restarting from scratch or leaving OutputFilePath half-written.
+type JournalEntry struct {
+	PreviousState string    `json:"previous_state"`
+	NextState     string    `json:"next_state"`
+	StagingDir    string    `json:"staging_dir"`
+	Timestamp     time.Time `json:"timestamp"`
+	Completed     bool      `json:"completed"`
+}
+
+const journalFileName = "state.journal"
+const stagingRootName = ".staging"
+
+func journalPath(baseDir string) (string) {
+	return filepath.Join(baseDir, journalFileName)
+}
+
+func stagingRoot(baseDir string) (string) {
+	return filepath.Join(baseDir, stagingRootName)
+}
+
+// ReservedPaths returns the paths under baseDir that belong to the
+// state machine's own bookkeeping (the journal file and the staging
+// root) rather than to ipv666's regular working directories. Callers
+// that wipe stale state from baseDir (e.g. input.cleanUpWorkingDirectories)
+// should exclude these so they don't delete the journal entry or
+// in-flight staging data a transition just wrote.
+func ReservedPaths(baseDir string) ([]string) {
+	return []string{journalPath(baseDir), stagingRoot(baseDir)}
+}
+
+// ReadStateFile returns the state currently recorded at statePath (the
+// same file SetStateFile writes), so a caller about to begin a new
+// transition can record the real state it's transitioning *from*
+// rather than a description of the action it's performing. A missing
+// state file is returned as-is (via the usual os.IsNotExist check) so
+// callers can tell "no run has ever completed" apart from a read
+// failure.
+func ReadStateFile(statePath string) (string, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func appendJournalEntry(baseDir string, entry JournalEntry) (error) {
+	file, err := os.OpenFile(journalPath(baseDir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ReadJournal returns every entry recorded in baseDir's state.journal,
+// oldest first. A journal that doesn't exist yet is not an error -- it
+// just means no transition has ever been started.
+func ReadJournal(baseDir string) ([]JournalEntry, error) {
+	var toReturn []JournalEntry
+	data, err := ioutil.ReadFile(journalPath(baseDir))
+	if os.IsNotExist(err) {
+		return toReturn, nil
+	} else if err != nil {
+		return toReturn, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return toReturn, err
+		}
+		toReturn = append(toReturn, entry)
+	}
+	return toReturn, nil
+}
+
+// PendingTransition returns the journal entry for the most recently
+// started transition if it was never marked as completed, so that the
+// caller can decide whether to resume it. It returns nil if the last
+// recorded transition finished cleanly, or if no transition has ever
+// been started.
+func PendingTransition(baseDir string) (*JournalEntry, error) {
+	entries, err := ReadJournal(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	last := entries[len(entries)-1]
+	if last.Completed {
+		return nil, nil
+	}
+	return &last, nil
+}
+
+// PruneStaleStaging removes every directory under baseDir's staging
+// root except the one belonging to the current pending transition, if
+// any. Commit only ever cleans up the staging directory it committed,
+// so a run that crashes or is interrupted mid-transition leaves its
+// staging directory behind forever; calling this once at startup, ahead
+// of BeginTransition, keeps those from accumulating indefinitely across
+// repeated interruptions.
+func PruneStaleStaging(baseDir string) (int, error) {
+	pending, err := PendingTransition(baseDir)
+	if err != nil {
+		return 0, err
+	}
+	var keep string
+	if pending != nil {
+		keep = pending.StagingDir
+	}
+	root := stagingRoot(baseDir)
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	numPruned := 0
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			l.Warnf("Error thrown when pruning stale staging directory '%s': %e", path, err)
+			return numPruned, err
+		}
+		numPruned++
+	}
+	if numPruned > 0 {
+		l.Infof("Pruned %d stale staging director(ies) under '%s'.", numPruned, root)
+	}
+	return numPruned, nil
+}
+
+// PullerState tracks the staging directory, expected inputs, and
+// produced outputs of a single state-machine transition. Outputs are
+// written into the staging directory and only renamed into their final
+// location once Commit is called, mirroring the resumable puller
+// redesign syncthing adopted for its own file pulling code -- a crash
+// partway through a transition leaves the previous state's output
+// files untouched rather than a half-written mix of old and new data.
+type PullerState struct {
+	BaseDir        string
+	PreviousState  string
+	NextState      string
+	StagingDir     string
+	ExpectedInputs []string
+	BytesWritten   int64
+	manifest       []string
+}
+
+// BeginTransition creates a staging directory under baseDir and journals
+// the intent to move from previousState to nextState. The returned
+// PullerState is used to stage output files before they are committed.
+func BeginTransition(baseDir string, previousState string, nextState string, expectedInputs []string) (*PullerState, error) {
+	stagingDir := filepath.Join(stagingRoot(baseDir), fmt.Sprintf("%s-%d", nextState, time.Now().UnixNano()))
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		l.Warnf("Error thrown when creating staging directory at '%s': %e", stagingDir, err)
+		return nil, err
+	}
+	entry := JournalEntry{
+		PreviousState: previousState,
+		NextState:     nextState,
+		StagingDir:    stagingDir,
+		Timestamp:     time.Now(),
+	}
+	if err := appendJournalEntry(baseDir, entry); err != nil {
+		l.Warnf("Error thrown when journaling transition from '%s' to '%s': %e", previousState, nextState, err)
+		return nil, err
+	}
+	l.Infof("Began transition from '%s' to '%s', staging in '%s'.", previousState, nextState, stagingDir)
+	return &PullerState{
+		BaseDir:        baseDir,
+		PreviousState:  previousState,
+		NextState:      nextState,
+		StagingDir:     stagingDir,
+		ExpectedInputs: expectedInputs,
+	}, nil
+}
+
+// Stage writes content into the staging directory under name, fsyncing
+// before returning so that a crash mid-write can never leave a
+// truncated file for Commit to pick up.
+func (ps *PullerState) Stage(name string, write func(io.Writer) (error)) (error) {
+	stagedPath := filepath.Join(ps.StagingDir, name)
+	if err := os.MkdirAll(filepath.Dir(stagedPath), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(stagedPath)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(stagedPath)
+	if err != nil {
+		return err
+	}
+	ps.BytesWritten += info.Size()
+	ps.manifest = append(ps.manifest, name)
+	return nil
+}
+
+// Manifest returns the names staged so far, in staging order.
+func (ps *PullerState) Manifest() ([]string) {
+	return ps.manifest
+}
+
+// Commit renames every staged file into outputDir one at a time and
+// then marks this transition as completed in the journal. If nothing
+// was staged (the transition only needed the journal's crash-resume
+// tracking, e.g. because its real outputs already went through their
+// own atomic writer such as the cas package) Commit just finalizes the
+// journal entry and removes the now-empty staging directory.
+func (ps *PullerState) Commit(outputDir string) (error) {
+	start := time.Now()
+	defer func() {
+		transitionCommitTimer.Update(time.Since(start))
+	}()
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	for _, name := range ps.manifest {
+		src := filepath.Join(ps.StagingDir, name)
+		dst := filepath.Join(outputDir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			l.Warnf("Error thrown when committing staged file '%s' to '%s': %e", src, dst, err)
+			return err
+		}
+	}
+	if err := os.RemoveAll(ps.StagingDir); err != nil {
+		l.Warnf("Error thrown when cleaning up staging directory '%s': %e", ps.StagingDir, err)
+	}
+	entry := JournalEntry{
+		PreviousState: ps.PreviousState,
+		NextState:     ps.NextState,
+		StagingDir:    ps.StagingDir,
+		Timestamp:     time.Now(),
+		Completed:     true,
+	}
+	if err := appendJournalEntry(ps.BaseDir, entry); err != nil {
+		l.Warnf("Error thrown when journaling completion of transition to '%s': %e", ps.NextState, err)
+		return err
+	}
+	transitionCommitCounter.Inc(1)
+	l.Infof("Committed transition from '%s' to '%s' (%d staged file(s), %d bytes).", ps.PreviousState, ps.NextState, len(ps.manifest), ps.BytesWritten)
+	return nil
+}